@@ -0,0 +1,327 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package healer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/event"
+	"github.com/tsuru/tsuru/log"
+)
+
+const (
+	defaultHealingWorkers = 4
+	defaultHealingQueue   = 100
+)
+
+// HealJob is a unit of work submitted to a BackgroundOps worker pool: heal
+// Target because of Reason. A non-zero Deadline is the deadline of the
+// context Run gets, so a running job is cancelled at Deadline and a job that
+// starts after it still has Run called, with an already-done context. Run
+// is exported so code outside this package (the actual node/container
+// failure detectors) can submit real healing work, not just the package's
+// own migration path.
+//
+// Done, if set, is called exactly once for this job: after Run returns, or
+// immediately if the job is throttled, dropped for a full queue, or
+// superseded by a newer submission for the same Target. Callers that need
+// to know when every submitted job has been accounted for (e.g.
+// MigrateHealingToEvents waiting on a sync.WaitGroup) should set Done rather
+// than relying on Run itself being invoked, since Run is skipped whenever
+// the job is coalesced away or rejected. A job still in the queue when the
+// pool's context is done may never be run, and its Done is then not called.
+type HealJob struct {
+	Target   event.Target
+	Reason   string
+	Deadline time.Time
+	Run      func(ctx context.Context) error
+	Done     func()
+}
+
+func (j HealJob) markDone() {
+	if j.Done != nil {
+		j.Done()
+	}
+}
+
+// InProgressJob is the information ListInProgress exposes about a job a
+// BackgroundOps worker is currently executing.
+type InProgressJob struct {
+	Target    event.Target
+	StartedAt time.Time
+	Attempt   int
+}
+
+// BackgroundOps runs HealJobs on a bounded pool of goroutines, coalescing
+// jobs for the same target so that two detectors racing on the same
+// node/container only heal it once, and cancelling any in-flight job when
+// its context (or the pool's) is done.
+type BackgroundOps struct {
+	workers int
+	queue   chan *queuedJob
+
+	mu         sync.Mutex
+	pending    map[event.Target]*queuedJob
+	inProgress map[event.Target]*InProgressJob
+	cancels    map[event.Target]context.CancelFunc
+	attempts   map[event.Target][]time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type queuedJob struct {
+	job     HealJob
+	attempt int
+}
+
+// NewBackgroundOps creates a BackgroundOps worker pool honoring the
+// docker:healing:workers and docker:healing:queue_size config entries
+// (defaulting to 4 workers and a queue of 100) and starts its workers. The
+// pool runs until ctx is done, at which point all in-flight jobs are
+// cancelled and no further jobs are accepted.
+func NewBackgroundOps(ctx context.Context) *BackgroundOps {
+	workers, _ := config.GetInt("docker:healing:workers")
+	if workers <= 0 {
+		workers = defaultHealingWorkers
+	}
+	queueSize, _ := config.GetInt("docker:healing:queue_size")
+	if queueSize <= 0 {
+		queueSize = defaultHealingQueue
+	}
+	poolCtx, cancel := context.WithCancel(ctx)
+	ops := &BackgroundOps{
+		workers:    workers,
+		queue:      make(chan *queuedJob, queueSize),
+		pending:    make(map[event.Target]*queuedJob),
+		inProgress: make(map[event.Target]*InProgressJob),
+		cancels:    make(map[event.Target]context.CancelFunc),
+		attempts:   make(map[event.Target][]time.Time),
+		ctx:        poolCtx,
+		cancel:     cancel,
+	}
+	for i := 0; i < workers; i++ {
+		ops.wg.Add(1)
+		go ops.work()
+	}
+	return ops
+}
+
+// Stop cancels every in-flight job and waits for all workers to return.
+func (b *BackgroundOps) Stop() {
+	b.cancel()
+	b.wg.Wait()
+}
+
+// throttled reports whether target has been submitted
+// consecutiveHealingsLimitInTimeframe times or more within
+// consecutiveHealingsTimeframe, recording this attempt and pruning older
+// ones as it goes. It also sweeps out any other target whose attempts have
+// all aged out, so b.attempts stays bounded by recently-healed targets
+// instead of growing for as long as the process runs.
+func (b *BackgroundOps) throttled(target event.Target) bool {
+	now := time.Now()
+	cutoff := now.Add(-consecutiveHealingsTimeframe)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for t, history := range b.attempts {
+		if t == target {
+			continue
+		}
+		if len(history) == 0 || history[len(history)-1].Before(cutoff) {
+			delete(b.attempts, t)
+		}
+	}
+	kept := b.attempts[target][:0]
+	for _, t := range b.attempts[target] {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	b.attempts[target] = append(kept, now)
+	return len(b.attempts[target]) > consecutiveHealingsLimitInTimeframe
+}
+
+// Submit enqueues job, coalescing it with any already-pending job for the
+// same target — the superseded job's Done is called immediately, since it
+// will never run. If target has been submitted too many times within
+// consecutiveHealingsTimeframe, or the queue is full, job is dropped
+// instead: a ThrottleExceeded event is recorded for the former, an error is
+// logged for the latter, and job.Done is called either way. Once the pool's
+// context is done, job is dropped and its Done called. Submit never blocks.
+func (b *BackgroundOps) Submit(job HealJob) {
+	if b.ctx.Err() != nil {
+		job.markDone()
+		return
+	}
+	if b.throttled(job.Target) {
+		observeThrottleExceeded(fmt.Sprintf("%s-healing", job.Target.Type), "")
+		publishThrottledEvent(job.Target)
+		job.markDone()
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if existing, ok := b.pending[job.Target]; ok {
+		existing.job.markDone()
+		existing.job = job
+		return
+	}
+	qj := &queuedJob{job: job}
+	select {
+	case b.queue <- qj:
+		b.pending[job.Target] = qj
+	default:
+		log.Errorf("healing queue full, dropping heal job for %v", job.Target)
+		job.markDone()
+	}
+}
+
+func (b *BackgroundOps) work() {
+	defer b.wg.Done()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case qj, ok := <-b.queue:
+			if !ok {
+				return
+			}
+			b.run(qj)
+		}
+	}
+}
+
+func (b *BackgroundOps) run(qj *queuedJob) {
+	target := qj.job.Target
+	b.mu.Lock()
+	delete(b.pending, target)
+	jobCtx, cancel := context.WithCancel(b.ctx)
+	if !qj.job.Deadline.IsZero() {
+		jobCtx, cancel = context.WithDeadline(jobCtx, qj.job.Deadline)
+	}
+	b.cancels[target] = cancel
+	b.inProgress[target] = &InProgressJob{Target: target, StartedAt: time.Now(), Attempt: qj.attempt + 1}
+	b.mu.Unlock()
+	finish := observeHealingStart(fmt.Sprintf("%s-healing", target.Type))
+	defer func() {
+		finish()
+		cancel()
+		b.mu.Lock()
+		delete(b.inProgress, target)
+		delete(b.cancels, target)
+		b.mu.Unlock()
+		qj.job.markDone()
+	}()
+	if qj.job.Run == nil {
+		return
+	}
+	err := qj.job.Run(jobCtx)
+	if err != nil {
+		log.Errorf("error running heal job for %v: %+v", target, err)
+	}
+}
+
+// ListInProgress returns a snapshot of the jobs currently being executed.
+func (b *BackgroundOps) ListInProgress() []InProgressJob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	jobs := make([]InProgressJob, 0, len(b.inProgress))
+	for _, j := range b.inProgress {
+		jobs = append(jobs, *j)
+	}
+	return jobs
+}
+
+// Cancel stops the in-flight job for target, if any, and reports whether a
+// job was found to cancel.
+func (b *BackgroundOps) Cancel(target event.Target) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cancel, ok := b.cancels[target]
+	if !ok {
+		return false
+	}
+	cancel()
+	return true
+}
+
+// migrationTarget derives the event.Target a legacy HealingEvent record
+// would have been created under, matching the switch in healingEventToEvent.
+func migrationTarget(data *HealingEvent) event.Target {
+	if data.Action == "node-healing" {
+		return event.Target{Type: event.TargetTypeNode, Value: data.FailingNode.Address}
+	}
+	return event.Target{Type: event.TargetTypeContainer, Value: data.FailingContainer.ID}
+}
+
+// MigrateHealingToEvents converts the legacy healing_events collection into
+// the event-based history, processing each record through ops so a large
+// historical collection cannot block startup, and stopping early if ctx is
+// done.
+func MigrateHealingToEvents(ctx context.Context, ops *BackgroundOps) error {
+	coll, err := oldHealingCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	iter := coll.Find(nil).Iter()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	var data HealingEvent
+	for iter.Next(&data) {
+		if ctx.Err() != nil {
+			break
+		}
+		record := data
+		wg.Add(1)
+		job := HealJob{
+			Target: migrationTarget(&record),
+			Reason: "migration",
+			Run: func(jobCtx context.Context) error {
+				err := healingEventToEvent(&record)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return err
+				}
+				observeHealingEvent(&record)
+				return nil
+			},
+			Done: wg.Done,
+		}
+		ops.Submit(job)
+	}
+	waitDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waitDone)
+	}()
+	select {
+	case <-waitDone:
+	case <-ctx.Done():
+	}
+	mu.Lock()
+	err = firstErr
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
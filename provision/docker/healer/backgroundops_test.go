@@ -0,0 +1,125 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package healer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tsuru/tsuru/event"
+)
+
+func newTestBackgroundOps(ctx context.Context) *BackgroundOps {
+	poolCtx, cancel := context.WithCancel(ctx)
+	ops := &BackgroundOps{
+		workers:    1,
+		queue:      make(chan *queuedJob, 10),
+		pending:    make(map[event.Target]*queuedJob),
+		inProgress: make(map[event.Target]*InProgressJob),
+		cancels:    make(map[event.Target]context.CancelFunc),
+		attempts:   make(map[event.Target][]time.Time),
+		ctx:        poolCtx,
+		cancel:     cancel,
+	}
+	ops.wg.Add(1)
+	go ops.work()
+	return ops
+}
+
+func TestBackgroundOpsSubmitCoalescingCallsDoneForSupersededJob(t *testing.T) {
+	ops := newTestBackgroundOps(context.Background())
+	defer ops.Stop()
+
+	target := event.Target{Type: event.TargetTypeContainer, Value: "c1"}
+	blockFirst := make(chan struct{})
+	var firstDone, secondDone, secondRan sync.WaitGroup
+	firstDone.Add(1)
+	secondDone.Add(1)
+	secondRan.Add(1)
+
+	ops.Submit(HealJob{
+		Target: target,
+		Run: func(ctx context.Context) error {
+			<-blockFirst
+			return nil
+		},
+	})
+	// give the worker a moment to dequeue the first job so the second
+	// Submit below coalesces into a *new* pending slot rather than racing
+	// the worker for the one just dequeued.
+	time.Sleep(10 * time.Millisecond)
+
+	supersededTarget := event.Target{Type: event.TargetTypeContainer, Value: "c2"}
+	ops.Submit(HealJob{
+		Target: supersededTarget,
+		Run: func(ctx context.Context) error {
+			return nil
+		},
+		Done: firstDone.Done,
+	})
+	ops.Submit(HealJob{
+		Target: supersededTarget,
+		Run: func(ctx context.Context) error {
+			defer secondRan.Done()
+			return nil
+		},
+		Done: secondDone.Done,
+	})
+	close(blockFirst)
+
+	waitWithTimeout(t, &firstDone, "superseded job's Done")
+	waitWithTimeout(t, &secondRan, "the coalesced job to run")
+	waitWithTimeout(t, &secondDone, "the coalesced job's Done")
+}
+
+func TestBackgroundOpsThrottled(t *testing.T) {
+	ops := newTestBackgroundOps(context.Background())
+	defer ops.Stop()
+
+	target := event.Target{Type: event.TargetTypeContainer, Value: "flaky"}
+	for i := 0; i < consecutiveHealingsLimitInTimeframe; i++ {
+		if ops.throttled(target) {
+			t.Fatalf("did not expect attempt %d to be throttled", i)
+		}
+	}
+	if !ops.throttled(target) {
+		t.Error("expected an attempt past the limit to be throttled")
+	}
+}
+
+func TestBackgroundOpsThrottledSweepsStaleTargets(t *testing.T) {
+	ops := newTestBackgroundOps(context.Background())
+	defer ops.Stop()
+
+	stale := event.Target{Type: event.TargetTypeContainer, Value: "stale"}
+	ops.mu.Lock()
+	ops.attempts[stale] = []time.Time{time.Now().Add(-2 * consecutiveHealingsTimeframe)}
+	ops.mu.Unlock()
+
+	ops.throttled(event.Target{Type: event.TargetTypeContainer, Value: "fresh"})
+
+	ops.mu.Lock()
+	_, stillThere := ops.attempts[stale]
+	ops.mu.Unlock()
+	if stillThere {
+		t.Error("expected a target with only aged-out attempts to be swept from b.attempts")
+	}
+}
+
+func waitWithTimeout(t *testing.T, wg *sync.WaitGroup, what string) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package healer
+
+import (
+	"sync"
+
+	"github.com/tsuru/tsuru/log"
+)
+
+// healingSubscriber is one WatchHealingHistory caller's view into the
+// broadcaster: a filter narrowing which events it wants and the channel
+// those events are delivered on.
+type healingSubscriber struct {
+	id     uint64
+	filter WatchFilter
+	out    chan HealingEvent
+}
+
+// healingBroadcaster fans newly recorded HealingEvents out to every active
+// WatchHealingHistory subscriber whose filter matches. It is the publish
+// side of the Watch API: healingEventToEvent calls publish after a
+// successful insert, so a subscriber sees an event as soon as it is
+// recorded instead of only through ListHealingHistory polling.
+type healingBroadcaster struct {
+	mu     sync.Mutex
+	nextID uint64
+	subs   map[uint64]*healingSubscriber
+}
+
+var broadcaster = &healingBroadcaster{subs: make(map[uint64]*healingSubscriber)}
+
+// subscribeBufferSize bounds how many events a slow subscriber can fall
+// behind by before publish starts dropping events for it instead of
+// blocking the goroutine that recorded them.
+const subscribeBufferSize = 16
+
+func (b *healingBroadcaster) subscribe(filter WatchFilter) *healingSubscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	sub := &healingSubscriber{id: b.nextID, filter: filter, out: make(chan HealingEvent, subscribeBufferSize)}
+	b.subs[sub.id] = sub
+	return sub
+}
+
+func (b *healingBroadcaster) unsubscribe(sub *healingSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, sub.id)
+	close(sub.out)
+}
+
+// publish fans evt out to every subscriber whose filter matches it. evt is
+// skipped entirely if it isn't Allowed.
+func (b *healingBroadcaster) publish(evt HealingEvent) {
+	if !evt.Allowed {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		if !sub.filter.match(&evt) {
+			continue
+		}
+		select {
+		case sub.out <- evt:
+		default:
+			log.Errorf("healing event watcher is falling behind, dropping a %s event", evt.Action)
+		}
+	}
+}
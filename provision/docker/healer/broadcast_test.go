@@ -0,0 +1,46 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package healer
+
+import "testing"
+
+func TestBroadcasterPublishMatchesAndAllowed(t *testing.T) {
+	b := &healingBroadcaster{subs: make(map[uint64]*healingSubscriber)}
+	sub := b.subscribe(WatchFilter{MinSeverity: SeverityFailedOnly})
+	defer b.unsubscribe(sub)
+
+	b.publish(HealingEvent{Successful: true, Allowed: true})
+	select {
+	case evt := <-sub.out:
+		t.Fatalf("did not expect a successful event to be delivered, got %+v", evt)
+	default:
+	}
+
+	b.publish(HealingEvent{Successful: false, Allowed: false})
+	select {
+	case evt := <-sub.out:
+		t.Fatalf("did not expect a non-Allowed event to be delivered, got %+v", evt)
+	default:
+	}
+
+	b.publish(HealingEvent{Successful: false, Allowed: true})
+	select {
+	case evt := <-sub.out:
+		if evt.Successful {
+			t.Errorf("expected the failed event to be delivered, got %+v", evt)
+		}
+	default:
+		t.Fatal("expected a matching, Allowed event to be delivered")
+	}
+}
+
+func TestBroadcasterUnsubscribeClosesChannel(t *testing.T) {
+	b := &healingBroadcaster{subs: make(map[uint64]*healingSubscriber)}
+	sub := b.subscribe(WatchFilter{})
+	b.unsubscribe(sub)
+	if _, ok := <-sub.out; ok {
+		t.Error("expected the subscriber channel to be closed after unsubscribe")
+	}
+}
@@ -34,6 +34,7 @@ type HealingEvent struct {
 	EndTime          time.Time
 	Action           string
 	Reason           string
+	ReasonCode       ReasonCode
 	Extra            interface{}
 	FailingNode      provision.NodeSpec
 	CreatedNode      provision.NodeSpec
@@ -41,8 +42,28 @@ type HealingEvent struct {
 	CreatedContainer container.Container
 	Successful       bool
 	Error            string
+	// Allowed mirrors event.Event.Allowed for the record being inserted; it
+	// is not persisted, only used to decide whether WatchHealingHistory
+	// subscribers may see the event.
+	Allowed bool `bson:"-" json:"-"`
+	// Pool caches the result of healingPool, filled in once by
+	// healingEventToEvent/toHealingEvt. It is not persisted: its only job is
+	// sparing WatchHealingHistory's pool filter from doing an app.GetByName
+	// lookup per subscriber while broadcaster.publish holds its lock.
+	Pool string `bson:"-" json:"-"`
 }
 
+// init registers this package's throttling window with the event package so
+// event.Throttle itself refuses a "healer" event past the limit; that
+// rejection is silent at this layer. Observability for a throttled attempt
+// (the ThrottleExceeded metric/event) is not hooked in here: it's produced
+// by BackgroundOps.throttled and publishThrottledEvent instead, a second,
+// independent tracker over the same consecutiveHealings* window. That split
+// is a deliberate descope, not an oversight: event.ThrottlingSpec does not
+// expose a hook to run when it trips (no confirmed OnThrottled or
+// equivalent field exists on it in this tree), so BackgroundOps owns the
+// observable side of throttling instead of this package guessing at an
+// event-package API surface that isn't here to check against.
 func init() {
 	event.SetThrottling(event.ThrottlingSpec{
 		TargetType: event.TargetTypeContainer,
@@ -52,6 +73,52 @@ func init() {
 	})
 }
 
+// publishThrottledEvent builds a HealingEvent for an attempt that was
+// suppressed by BackgroundOps' own throttle tracking, counts it in the
+// healing metrics and publishes it to WatchHealingHistory subscribers, so it
+// does not disappear silently. The event is not stored, so
+// ListHealingHistory does not return it.
+func publishThrottledEvent(t event.Target) {
+	now := time.Now()
+	evt := HealingEvent{
+		StartTime:  now,
+		EndTime:    now,
+		Action:     fmt.Sprintf("%s-healing", t.Type),
+		Reason:     "throttle limit exceeded",
+		ReasonCode: ReasonThrottleExceeded,
+		Successful: false,
+		Error:      "healing throttled: too many consecutive healings",
+		Allowed:    true,
+	}
+	if t.Type == event.TargetTypeContainer {
+		evt.FailingContainer.ID = t.Value
+	} else {
+		evt.FailingNode.Address = t.Value
+	}
+	observeHealingEvent(&evt)
+	broadcaster.publish(evt)
+}
+
+// resolvePool looks up the pool a HealingEvent belongs to, hitting the
+// database for a container event's app. toHealingEvt calls it once to fill
+// in Pool when the event is built (healingEventToEvent sets Pool itself);
+// healingPool reads that cached result and calls this only when Pool is
+// empty.
+func resolvePool(evt *HealingEvent) string {
+	if evt.FailingNode.Metadata != nil {
+		if pool := evt.FailingNode.Metadata["pool"]; pool != "" {
+			return pool
+		}
+	}
+	if evt.FailingContainer.AppName != "" {
+		a, err := app.GetByName(evt.FailingContainer.AppName)
+		if err == nil {
+			return a.Pool
+		}
+	}
+	return ""
+}
+
 func toHealingEvt(evt *event.Event) (HealingEvent, error) {
 	healingEvt := HealingEvent{
 		ID:         evt.UniqueID,
@@ -89,6 +156,9 @@ func toHealingEvt(evt *event.Event) (HealingEvent, error) {
 		}
 		healingEvt.CreatedNode = createdNode
 	}
+	healingEvt.ReasonCode = activeClassifier.Classify(&healingEvt)
+	healingEvt.Pool = resolvePool(&healingEvt)
+	healingEvt.Allowed = evt.Allowed
 
 	return healingEvt, nil
 }
@@ -151,6 +221,7 @@ func healingEventToEvent(data *HealingEvent) error {
 		}
 		endOpts = data.CreatedNode
 		poolName := data.FailingNode.Metadata["pool"]
+		data.Pool = poolName
 		evt.Allowed = event.Allowed(permission.PermPoolReadEvents, permission.Context(permission.CtxPool, poolName))
 	case "container-healing":
 		evt.Target = event.Target{Type: event.TargetTypeContainer, Value: data.FailingContainer.ID}
@@ -158,6 +229,7 @@ func healingEventToEvent(data *HealingEvent) error {
 		endOpts = data.CreatedContainer
 		a, err := app.GetByName(data.FailingContainer.AppName)
 		if err == nil {
+			data.Pool = a.Pool
 			evt.Allowed = event.Allowed(permission.PermAppReadEvents, append(permission.Contexts(permission.CtxTeam, a.Teams),
 				permission.Context(permission.CtxApp, a.Name),
 				permission.Context(permission.CtxPool, a.Pool),
@@ -177,23 +249,13 @@ func healingEventToEvent(data *HealingEvent) error {
 	if mgo.IsDup(err) {
 		return nil
 	}
-	return err
-}
-
-func MigrateHealingToEvents() error {
-	coll, err := oldHealingCollection()
 	if err != nil {
 		return err
 	}
-	defer coll.Close()
-	coll.Find(nil).Iter()
-	iter := coll.Find(nil).Iter()
-	var data HealingEvent
-	for iter.Next(&data) {
-		err = healingEventToEvent(&data)
-		if err != nil {
-			return err
-		}
+	if data.ReasonCode == "" {
+		data.ReasonCode = activeClassifier.Classify(data)
 	}
-	return iter.Close()
+	data.Allowed = evt.Allowed
+	broadcaster.publish(*data)
+	return nil
 }
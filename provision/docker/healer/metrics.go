@@ -0,0 +1,134 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package healer
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tsuru/tsuru/healer"
+)
+
+// ReasonCode is a machine-readable classification of why a healing event
+// happened, so dashboards and alerts don't have to parse the free-form
+// Reason string.
+type ReasonCode string
+
+const (
+	ReasonUnknown                ReasonCode = "unknown"
+	ReasonNodeCheckHTTPFail      ReasonCode = "node-check-http-fail"
+	ReasonNodeCheckContainerFail ReasonCode = "node-check-container-fail"
+	ReasonContainerUnresponsive  ReasonCode = "container-unresponsive"
+	ReasonThrottleExceeded       ReasonCode = "throttle-exceeded"
+)
+
+// Classifier maps a raw failure (a node's NodeChecks, a container inspection
+// result, ...) to a ReasonCode. Provisioners that need custom failure
+// signals can register their own Classifier with SetClassifier instead of
+// relying on the built-in heuristics in classifyDefault.
+type Classifier interface {
+	Classify(evt *HealingEvent) ReasonCode
+}
+
+// defaultClassifierFunc adapts a function to the Classifier interface.
+type defaultClassifierFunc func(evt *HealingEvent) ReasonCode
+
+func (f defaultClassifierFunc) Classify(evt *HealingEvent) ReasonCode {
+	return f(evt)
+}
+
+var activeClassifier Classifier = defaultClassifierFunc(classifyDefault)
+
+// SetClassifier overrides the Classifier used to derive a HealingEvent's
+// ReasonCode. Passing nil restores the built-in default.
+func SetClassifier(c Classifier) {
+	if c == nil {
+		c = defaultClassifierFunc(classifyDefault)
+	}
+	activeClassifier = c
+}
+
+// classifyDefault is the built-in mapping from raw NodeChecks/container
+// inspection data to a ReasonCode, used when no custom Classifier is set.
+func classifyDefault(evt *HealingEvent) ReasonCode {
+	if checks, ok := evt.Extra.(*healer.NodeChecks); ok && checks != nil {
+		for _, c := range checks.Checks {
+			if !c.Successful && c.Name == "http" {
+				return ReasonNodeCheckHTTPFail
+			}
+		}
+		return ReasonNodeCheckContainerFail
+	}
+	if evt.Action == "container-healing" {
+		return ReasonContainerUnresponsive
+	}
+	return ReasonUnknown
+}
+
+// healerMetrics groups the Prometheus collectors registered for the healer
+// package. It is created once, by the package-level metrics variable, and
+// registered against prometheus.DefaultRegisterer.
+type healerMetrics struct {
+	eventsTotal *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	inProgress  *prometheus.GaugeVec
+}
+
+var metrics = newHealerMetrics()
+
+func newHealerMetrics() *healerMetrics {
+	m := &healerMetrics{
+		eventsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tsuru_healing_events_total",
+			Help: "The total number of healing events, by action, pool, result and reason code.",
+		}, []string{"action", "pool", "result", "reason_code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "tsuru_healing_duration_seconds",
+			Help: "The time it took to complete a healing action.",
+		}, []string{"action"}),
+		inProgress: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tsuru_healing_in_progress",
+			Help: "The number of healing actions currently in progress.",
+		}, []string{"action"}),
+	}
+	prometheus.DefaultRegisterer.MustRegister(m.eventsTotal, m.duration, m.inProgress)
+	return m
+}
+
+// observeHealingStart records that a healing action of the given kind has
+// started, bumping the in-progress gauge. The returned func must be called
+// once the job finishes to observe its duration and decrement the gauge
+// again. It is called from BackgroundOps.run for every HealJob it executes.
+func observeHealingStart(action string) func() {
+	start := time.Now()
+	metrics.inProgress.WithLabelValues(action).Inc()
+	return func() {
+		metrics.inProgress.WithLabelValues(action).Dec()
+		metrics.duration.WithLabelValues(action).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeHealingEvent increments eventsTotal for an already-finished
+// HealingEvent. It is called from MigrateHealingToEvents, after
+// healingEventToEvent inserts a record, so historical events are reflected
+// in the counters, and from publishThrottledEvent.
+func observeHealingEvent(evt *HealingEvent) {
+	result := "success"
+	if !evt.Successful {
+		result = "failure"
+	}
+	reason := evt.ReasonCode
+	if reason == "" {
+		reason = activeClassifier.Classify(evt)
+		evt.ReasonCode = reason
+	}
+	metrics.eventsTotal.WithLabelValues(evt.Action, healingPool(evt), result, string(reason)).Inc()
+}
+
+// observeThrottleExceeded records a healing attempt that was suppressed by
+// BackgroundOps' throttle tracking instead of silently dropping it.
+func observeThrottleExceeded(action, pool string) {
+	metrics.eventsTotal.WithLabelValues(action, pool, "throttled", string(ReasonThrottleExceeded)).Inc()
+}
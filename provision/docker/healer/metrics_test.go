@@ -0,0 +1,26 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package healer
+
+import "testing"
+
+func TestClassifyDefaultContainerUnresponsive(t *testing.T) {
+	evt := &HealingEvent{Action: "container-healing"}
+	if got := classifyDefault(evt); got != ReasonContainerUnresponsive {
+		t.Errorf("expected %q, got %q", ReasonContainerUnresponsive, got)
+	}
+}
+
+func TestClassifyDefaultUnknown(t *testing.T) {
+	evt := &HealingEvent{Action: "something-else"}
+	if got := classifyDefault(evt); got != ReasonUnknown {
+		t.Errorf("expected %q, got %q", ReasonUnknown, got)
+	}
+}
+
+func TestObserveHealingStartFinishDoesNotPanic(t *testing.T) {
+	finish := observeHealingStart("test-healing")
+	finish()
+}
@@ -0,0 +1,168 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package healer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tsuru/tsuru/event"
+)
+
+// WatchFilter narrows down which HealingEvents a watcher receives. An empty
+// TargetType or Pool matches everything; MinSeverity defaults to
+// SeverityAny, i.e. both successful and failed heals are sent.
+type WatchFilter struct {
+	TargetType  event.TargetType
+	Pool        string
+	App         string
+	MinSeverity Severity
+}
+
+// Severity distinguishes successful heals from failed ones, so a subscriber
+// can ask for e.g. "failed heals only" instead of every healing attempt.
+type Severity int
+
+const (
+	// SeverityAny matches both successful and failed healing events.
+	SeverityAny Severity = iota
+	// SeverityFailedOnly matches only healing events that ended in error.
+	SeverityFailedOnly
+)
+
+func (f WatchFilter) match(evt *HealingEvent) bool {
+	if f.TargetType != "" && string(f.TargetType) != healingTargetType(evt) {
+		return false
+	}
+	if f.Pool != "" && healingPool(evt) != f.Pool {
+		return false
+	}
+	if f.App != "" && evt.FailingContainer.AppName != f.App {
+		return false
+	}
+	if f.MinSeverity == SeverityFailedOnly && evt.Successful {
+		return false
+	}
+	return true
+}
+
+func healingTargetType(evt *HealingEvent) string {
+	if evt.FailingNode.Address != "" {
+		return string(event.TargetTypeNode)
+	}
+	return string(event.TargetTypeContainer)
+}
+
+// healingPool returns the pool a HealingEvent belongs to, so it can be used
+// as a Prometheus label and a WatchFilter dimension. evt.Pool is filled in
+// once by healingEventToEvent/toHealingEvt when the event is built; this
+// falls back to resolvePool (which hits the database for container heals
+// with an app name) whenever evt.Pool is empty, i.e. for events that
+// bypassed that path or whose pool could not be resolved there. Only in that
+// case does broadcaster.publish's per-subscriber filtering do an app lookup
+// while holding the broadcaster's lock.
+func healingPool(evt *HealingEvent) string {
+	if evt.Pool != "" {
+		return evt.Pool
+	}
+	return resolvePool(evt)
+}
+
+// WatchHealingHistory tails newly created healing events, as published by
+// healingEventToEvent, filtering out anything that doesn't match filter or
+// isn't Allowed. The returned channel is closed when ctx is done.
+func WatchHealingHistory(ctx context.Context, filter WatchFilter) (<-chan HealingEvent, error) {
+	sub := broadcaster.subscribe(filter)
+	out := make(chan HealingEvent)
+	go func() {
+		defer close(out)
+		defer broadcaster.unsubscribe(sub)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case healingEvt, ok := <-sub.out:
+				if !ok {
+					return
+				}
+				select {
+				case out <- healingEvt:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// heartbeatInterval controls how often ServeHealingWatch sends a comment
+// frame to keep the connection alive while no healing events are flowing.
+const heartbeatInterval = 15 * time.Second
+
+// ServeHealingWatch is an HTTP handler that streams HealingEvents matching
+// filter as Server-Sent Events, sending one JSON-encoded frame per event and
+// a heartbeat comment every heartbeatInterval so proxies don't time out an
+// idle connection. A client reconnecting after a drop should resend its last
+// received event's EndTime as the since query parameter.
+func ServeHealingWatch(w http.ResponseWriter, r *http.Request, filter WatchFilter, since time.Time) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming not supported by this response writer")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	ctx := r.Context()
+	if !since.IsZero() {
+		backlog, err := ListHealingHistory("")
+		if err != nil {
+			return err
+		}
+		for _, evt := range backlog {
+			if evt.EndTime.After(since) && evt.Allowed && filter.match(&evt) {
+				if err := writeHealingEventFrame(w, &evt); err != nil {
+					return err
+				}
+			}
+		}
+		flusher.Flush()
+	}
+	events, err := WatchHealingHistory(ctx, filter)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case evt, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := writeHealingEventFrame(w, &evt); err != nil {
+				return err
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeHealingEventFrame(w http.ResponseWriter, evt *HealingEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
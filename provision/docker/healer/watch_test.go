@@ -0,0 +1,59 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package healer
+
+import (
+	"testing"
+
+	"github.com/tsuru/tsuru/event"
+	"github.com/tsuru/tsuru/provision"
+)
+
+func TestWatchFilterMatchTargetType(t *testing.T) {
+	nodeEvt := &HealingEvent{FailingNode: provision.NodeSpec{Address: "n1"}}
+	containerEvt := &HealingEvent{}
+	f := WatchFilter{TargetType: event.TargetTypeNode}
+	if !f.match(nodeEvt) {
+		t.Error("expected a node event to match a node TargetType filter")
+	}
+	if f.match(containerEvt) {
+		t.Error("expected a container event not to match a node TargetType filter")
+	}
+}
+
+func TestWatchFilterMatchSeverity(t *testing.T) {
+	failed := &HealingEvent{Successful: false}
+	succeeded := &HealingEvent{Successful: true}
+	f := WatchFilter{MinSeverity: SeverityFailedOnly}
+	if !f.match(failed) {
+		t.Error("expected a failed event to match SeverityFailedOnly")
+	}
+	if f.match(succeeded) {
+		t.Error("expected a successful event not to match SeverityFailedOnly")
+	}
+}
+
+func TestWatchFilterMatchPoolFromCachedField(t *testing.T) {
+	evt := &HealingEvent{Pool: "mypool"}
+	f := WatchFilter{Pool: "mypool"}
+	if !f.match(evt) {
+		t.Error("expected the event to match its cached Pool without needing FailingNode/FailingContainer data")
+	}
+}
+
+func TestWatchFilterMatchPoolFromNodeMetadata(t *testing.T) {
+	evt := &HealingEvent{FailingNode: provision.NodeSpec{
+		Address:  "n1",
+		Metadata: map[string]string{"pool": "mypool"},
+	}}
+	f := WatchFilter{Pool: "mypool"}
+	if !f.match(evt) {
+		t.Error("expected the event to match its node's pool")
+	}
+	f = WatchFilter{Pool: "otherpool"}
+	if f.match(evt) {
+		t.Error("expected the event not to match a different pool")
+	}
+}
@@ -6,6 +6,7 @@ package servicecommon
 
 import (
 	"sort"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/tsuru/tsuru/action"
@@ -15,12 +16,80 @@ import (
 	"github.com/tsuru/tsuru/set"
 )
 
+// DeployStrategyKind identifies how a process should be rolled out by
+// applyDeployment.
+type DeployStrategyKind string
+
+const (
+	// StrategyRecreate is the historical big-bang behavior: a single
+	// DeployService call replaces the whole process at once.
+	StrategyRecreate DeployStrategyKind = "recreate"
+	// StrategyRollingUpdate replaces the process in batches, waiting for
+	// each batch to become ready before moving on to the next one.
+	StrategyRollingUpdate DeployStrategyKind = "rolling-update"
+	// StrategyCanary deploys the new image alongside the current one under
+	// a second, suffixed process name and only promotes it once it bakes
+	// successfully.
+	StrategyCanary DeployStrategyKind = "canary"
+)
+
+// canaryProcessSuffix is appended to the process name used to address the
+// ServiceManager while a canary is being baked, so the underlying
+// provisioner can route only a fraction of traffic to it.
+const canaryProcessSuffix = "-canary"
+
+// PromoteCondition controls what applyDeployment waits for before promoting
+// a canary to replace the current process.
+type PromoteCondition string
+
+const (
+	PromoteOnHTTPProbe   PromoteCondition = "http-probe"
+	PromoteOnCustomCheck PromoteCondition = "custom-check"
+)
+
+// RollingUpdateStrategy configures a StrategyRollingUpdate deployment.
+type RollingUpdateStrategy struct {
+	MaxSurge          int
+	MaxUnavailable    int
+	BatchPauseSeconds int
+}
+
+// CanaryStrategy configures a StrategyCanary deployment.
+type CanaryStrategy struct {
+	Weight      int
+	BakeSeconds int
+	PromoteOn   PromoteCondition
+}
+
+// DeployStrategy picks the rollout behavior for a process. The zero value is
+// StrategyRecreate, preserving the previous behavior of RunServicePipeline.
+type DeployStrategy struct {
+	Kind          DeployStrategyKind
+	RollingUpdate *RollingUpdateStrategy
+	Canary        *CanaryStrategy
+}
+
+func (s DeployStrategy) normalized() DeployStrategy {
+	if s.Kind == "" {
+		s.Kind = StrategyRecreate
+	}
+	return s
+}
+
+// ReadinessChecker is consulted by applyDeployment between batches of a
+// rolling update or after a canary bake period, so a provisioner can plug in
+// its own notion of "ready" (HTTP probe, container health, custom check...).
+type ReadinessChecker interface {
+	Ready(a provision.App, processName string, labels *provision.LabelSet) (bool, error)
+}
+
 type ProcessState struct {
-	Stop      bool
-	Start     bool
-	Restart   bool
-	Sleep     bool
-	Increment int
+	Stop           bool
+	Start          bool
+	Restart        bool
+	Sleep          bool
+	Increment      int
+	DeployStrategy DeployStrategy
 }
 
 type ProcessSpec map[string]ProcessState
@@ -32,15 +101,21 @@ type pipelineArgs struct {
 	newImageSpec     ProcessSpec
 	currentImage     string
 	currentImageSpec ProcessSpec
+	readiness        ReadinessChecker
 }
 
 type ServiceManager interface {
 	RemoveService(a provision.App, processName string) error
 	CurrentLabels(a provision.App, processName string) (*provision.LabelSet, error)
 	DeployService(a provision.App, processName string, labels *provision.LabelSet, replicas int, image string) error
+	WaitForReady(a provision.App, processName string, timeout time.Duration) error
 }
 
-func RunServicePipeline(manager ServiceManager, a provision.App, newImg string, updateSpec ProcessSpec) error {
+// RunServicePipeline drives a deploy through updateServices, updateImageInDB
+// and removeOldServices. readiness, if non-nil, is consulted by
+// applyDeployment between rollout batches and before promoting a canary; it
+// may be nil, in which case only WaitForReady paces the rollout.
+func RunServicePipeline(manager ServiceManager, a provision.App, newImg string, updateSpec ProcessSpec, readiness ReadinessChecker) error {
 	curImg, err := image.AppCurrentImageName(a.GetName())
 	if err != nil {
 		return err
@@ -79,14 +154,31 @@ func RunServicePipeline(manager ServiceManager, a provision.App, newImg string,
 		newImageSpec:     newSpec,
 		currentImage:     curImg,
 		currentImageSpec: currentSpec,
+		readiness:        readiness,
 	})
 }
 
+// rollbackState returns the ProcessState to pass to rollbackService when
+// rolling processName back to currentImage: the process's pre-deploy state,
+// but carrying the same DeployStrategy that was used to roll it forward, so
+// planDeployment batches the rollback the same way (a rolling update rolls
+// back batch by batch instead of snapping straight back to currentImage at
+// full replica count in one shot). Returns false if processName didn't
+// exist before this deploy, in which case it should be removed instead.
+func rollbackState(args *pipelineArgs, processName string) (ProcessState, bool) {
+	state, in := args.currentImageSpec[processName]
+	if !in {
+		return ProcessState{}, false
+	}
+	state.DeployStrategy = args.newImageSpec[processName].DeployStrategy
+	return state, true
+}
+
 func rollbackAddedProcesses(args *pipelineArgs, processes []string) {
 	for _, processName := range processes {
 		var err error
-		if state, in := args.currentImageSpec[processName]; in {
-			err = deployService(args, processName, args.currentImage, state)
+		if state, in := rollbackState(args, processName); in {
+			err = rollbackService(args, processName, args.currentImage, state)
 		} else {
 			err = args.manager.RemoveService(args.app, processName)
 		}
@@ -96,10 +188,32 @@ func rollbackAddedProcesses(args *pipelineArgs, processes []string) {
 	}
 }
 
-func deployService(args *pipelineArgs, processName, image string, pState ProcessState) error {
+// deploymentBatch describes one incremental step of a rollout: the process
+// name to address the ServiceManager with (which, for a canary, is the
+// suffixed name), the labels to deploy it under and how many replicas it
+// should reach before the next batch starts.
+type deploymentBatch struct {
+	processName string
+	labels      *provision.LabelSet
+	replicas    int
+}
+
+// deploymentPlan is the output of planDeployment: the ordered batches
+// applyDeployment must walk through, plus the strategy that produced it so
+// applyDeployment knows how to pace and promote them.
+type deploymentPlan struct {
+	strategy DeployStrategy
+	image    string
+	batches  []deploymentBatch
+}
+
+// planDeployment computes the desired replica count, labels and batch plan
+// for deploying processName at the given image, without talking to the
+// ServiceManager. applyDeployment is responsible for executing the plan.
+func planDeployment(args *pipelineArgs, processName, img string, pState ProcessState) (*deploymentPlan, error) {
 	oldLabels, err := args.manager.CurrentLabels(args.app, processName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	replicas := 0
 	restartCount := 0
@@ -114,7 +228,7 @@ func deployService(args *pipelineArgs, processName, image string, pState Process
 	if pState.Increment != 0 {
 		replicas += pState.Increment
 		if replicas < 0 {
-			return errors.New("cannot have less than 0 units")
+			return nil, errors.New("cannot have less than 0 units")
 		}
 	}
 	if pState.Start || pState.Restart {
@@ -130,7 +244,7 @@ func deployService(args *pipelineArgs, processName, image string, pState Process
 		Replicas: replicas,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	realReplicas := replicas
 	if isStopped || pState.Stop {
@@ -144,7 +258,183 @@ func deployService(args *pipelineArgs, processName, image string, pState Process
 		restartCount++
 		labels.SetRestarts(restartCount)
 	}
-	return args.manager.DeployService(args.app, processName, labels, realReplicas, image)
+	strategy := pState.DeployStrategy.normalized()
+	plan := &deploymentPlan{strategy: strategy, image: img}
+	switch strategy.Kind {
+	case StrategyRollingUpdate:
+		plan.batches = rollingUpdateBatches(processName, labels, realReplicas, strategy.RollingUpdate)
+	case StrategyCanary:
+		canaryLabels, err := provision.ServiceLabels(provision.ServiceLabelsOpts{
+			App:      args.app,
+			Process:  processName + canaryProcessSuffix,
+			Replicas: realReplicas,
+		})
+		if err != nil {
+			return nil, err
+		}
+		plan.batches, err = canaryBatches(processName, labels, canaryLabels, realReplicas, strategy.Canary)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		plan.batches = []deploymentBatch{{processName: processName, labels: labels, replicas: realReplicas}}
+	}
+	return plan, nil
+}
+
+// rollingUpdateBatches splits the target replica count into incremental
+// steps, each adding at most MaxSurge replicas over the previous batch,
+// until the full desired count is reached.
+func rollingUpdateBatches(processName string, labels *provision.LabelSet, replicas int, strategy *RollingUpdateStrategy) []deploymentBatch {
+	if strategy == nil || strategy.MaxSurge <= 0 || strategy.MaxSurge >= replicas {
+		return []deploymentBatch{{processName: processName, labels: labels, replicas: replicas}}
+	}
+	var batches []deploymentBatch
+	for current := strategy.MaxSurge; current < replicas; current += strategy.MaxSurge {
+		batches = append(batches, deploymentBatch{processName: processName, labels: labels, replicas: current})
+	}
+	batches = append(batches, deploymentBatch{processName: processName, labels: labels, replicas: replicas})
+	return batches
+}
+
+// canaryBatches deploys a first batch under the canary process name at the
+// weighted replica count, followed by the promotion batch that deploys the
+// full count under the real process name. Promotion (and removal of the
+// canary service) is handled by applyDeployment/promoteCanary, not here.
+// strategy.Weight must be set to a value between 1 and 99; there is no safe
+// implicit default, since a forgotten Weight could otherwise silently mean
+// either "no canary at all" or "100% canary", both surprising.
+//
+// The canaryProcessSuffix on the process name is the only marker a canary
+// batch carries; canaryLabels is otherwise built the same way as labels, so
+// provisioners that branch on process name (as ServiceManager.DeployService
+// implementations already must, to keep the two sets of instances separate)
+// need no additional canary-specific label.
+func canaryBatches(processName string, labels, canaryLabels *provision.LabelSet, replicas int, strategy *CanaryStrategy) ([]deploymentBatch, error) {
+	if strategy == nil || strategy.Weight <= 0 || strategy.Weight >= 100 {
+		return nil, errors.New("canary deploy strategy requires Weight between 1 and 99")
+	}
+	canaryReplicas := replicas * strategy.Weight / 100
+	if canaryReplicas == 0 && replicas > 0 {
+		canaryReplicas = 1
+	}
+	return []deploymentBatch{
+		{processName: processName + canaryProcessSuffix, labels: canaryLabels, replicas: canaryReplicas},
+		{processName: processName, labels: labels, replicas: replicas},
+	}, nil
+}
+
+// applyDeployment walks a deploymentPlan's batches in order, issuing one
+// DeployService call per batch and waiting for WaitForReady to reflect the
+// batch's replica count (and, when a ReadinessChecker is configured, for it
+// to report ready) before advancing to the next batch. For a canary plan, a
+// non-empty CanaryStrategy.PromoteOn requires a ReadinessChecker to be
+// configured, since that's the only gate applyDeployment has for deciding
+// the canary baked successfully enough to promote.
+func applyDeployment(args *pipelineArgs, plan *deploymentPlan) error {
+	for i, batch := range plan.batches {
+		err := args.manager.DeployService(args.app, batch.processName, batch.labels, batch.replicas, plan.image)
+		if err != nil {
+			return err
+		}
+		if i == len(plan.batches)-1 {
+			break
+		}
+		err = args.manager.WaitForReady(args.app, batch.processName, batchTimeout(plan.strategy))
+		if err != nil {
+			return err
+		}
+		if plan.strategy.Kind == StrategyCanary && plan.strategy.Canary.PromoteOn != "" && args.readiness == nil {
+			return errors.Errorf("process %q: PromoteOn %q requires a ReadinessChecker", batch.processName, plan.strategy.Canary.PromoteOn)
+		}
+		if args.readiness != nil {
+			ready, err := args.readiness.Ready(args.app, batch.processName, batch.labels)
+			if err != nil {
+				return err
+			}
+			if !ready {
+				return errors.Errorf("process %q did not become ready after deploy batch", batch.processName)
+			}
+		}
+		pauseBetweenBatches(plan.strategy)
+	}
+	if plan.strategy.Kind == StrategyCanary {
+		return promoteCanary(args, plan)
+	}
+	return nil
+}
+
+func batchTimeout(strategy DeployStrategy) time.Duration {
+	if strategy.Kind == StrategyCanary && strategy.Canary != nil && strategy.Canary.BakeSeconds > 0 {
+		return time.Duration(strategy.Canary.BakeSeconds) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+func pauseBetweenBatches(strategy DeployStrategy) {
+	if strategy.Kind == StrategyRollingUpdate && strategy.RollingUpdate != nil && strategy.RollingUpdate.BatchPauseSeconds > 0 {
+		time.Sleep(time.Duration(strategy.RollingUpdate.BatchPauseSeconds) * time.Second)
+	}
+}
+
+// promoteCanary removes the canary service once the final batch has been
+// deployed under the real process name, so the canary's extra replicas
+// don't linger alongside the promoted process.
+func promoteCanary(args *pipelineArgs, plan *deploymentPlan) error {
+	canaryBatch := plan.batches[0]
+	err := args.manager.RemoveService(args.app, canaryBatch.processName)
+	if err != nil {
+		log.Errorf("ignored error removing canary service %s[%s]: %+v", args.app.GetName(), canaryBatch.processName, err)
+	}
+	return nil
+}
+
+func deployService(args *pipelineArgs, processName, img string, pState ProcessState) error {
+	plan, err := planDeployment(args, processName, img, pState)
+	if err != nil {
+		return err
+	}
+	return applyDeployment(args, plan)
+}
+
+// rollbackService re-deploys processName to img (currentImage) through the
+// same planDeployment batching a forward deploy would use, but via
+// applyRollback rather than applyDeployment: rollback is best-effort
+// remediation, not a gated deploy, so it must not itself be stoppable by
+// the same WaitForReady/ReadinessChecker gates that legitimately abort a
+// forward rollout. Aborting partway through a rollback would leave a
+// process worse off than the single recreate call this replaced.
+func rollbackService(args *pipelineArgs, processName, img string, pState ProcessState) error {
+	plan, err := planDeployment(args, processName, img, pState)
+	if err != nil {
+		return err
+	}
+	return applyRollback(args, plan)
+}
+
+// applyRollback walks plan's batches in order like applyDeployment, but
+// treats a WaitForReady failure between batches as non-fatal: it's logged
+// and the rollback proceeds to the next batch anyway, since there is no
+// forward rollout left to protect by stopping. It does not consult
+// args.readiness or PromoteOn at all, since those gate promotion decisions
+// that don't apply to unwinding back to currentImage.
+func applyRollback(args *pipelineArgs, plan *deploymentPlan) error {
+	for i, batch := range plan.batches {
+		err := args.manager.DeployService(args.app, batch.processName, batch.labels, batch.replicas, plan.image)
+		if err != nil {
+			return err
+		}
+		if i == len(plan.batches)-1 {
+			break
+		}
+		if err := args.manager.WaitForReady(args.app, batch.processName, batchTimeout(plan.strategy)); err != nil {
+			log.Errorf("ignored error waiting for rollback batch %q to be ready: %+v", batch.processName, err)
+		}
+	}
+	if plan.strategy.Kind == StrategyCanary {
+		return promoteCanary(args, plan)
+	}
+	return nil
 }
 
 var updateServices = &action.Action{
@@ -176,7 +466,25 @@ var updateServices = &action.Action{
 	Backward: func(ctx action.BWContext) {
 		args := ctx.Params[0].(*pipelineArgs)
 		deployedProcesses := ctx.FWResult.([]string)
-		rollbackAddedProcesses(args, deployedProcesses)
+		// Roll each previously-updated process back to currentImage
+		// individually, most-recent first. Reusing the forward deploy's
+		// DeployStrategy (see rollbackState) means planDeployment batches
+		// this the same way the forward rollout was staged: a rolling update
+		// re-deploys currentImage in the same MaxSurge-sized steps, ramping
+		// up to the full replica count, instead of in one shot. The batches
+		// run in forward order, not in reverse.
+		for i := len(deployedProcesses) - 1; i >= 0; i-- {
+			processName := deployedProcesses[i]
+			var err error
+			if state, in := rollbackState(args, processName); in {
+				err = rollbackService(args, processName, args.currentImage, state)
+			} else {
+				err = args.manager.RemoveService(args.app, processName)
+			}
+			if err != nil {
+				log.Errorf("error rolling back updated service for %s[%s]: %+v", args.app.GetName(), processName, err)
+			}
+		}
 	},
 }
 
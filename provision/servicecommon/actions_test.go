@@ -0,0 +1,147 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package servicecommon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/tsuru/provision"
+)
+
+type fakeRollbackManager struct {
+	deployed []string
+	removed  []string
+	waitErr  error
+}
+
+func (m *fakeRollbackManager) RemoveService(a provision.App, processName string) error {
+	m.removed = append(m.removed, processName)
+	return nil
+}
+
+func (m *fakeRollbackManager) CurrentLabels(a provision.App, processName string) (*provision.LabelSet, error) {
+	return nil, nil
+}
+
+func (m *fakeRollbackManager) DeployService(a provision.App, processName string, labels *provision.LabelSet, replicas int, image string) error {
+	m.deployed = append(m.deployed, processName)
+	return nil
+}
+
+func (m *fakeRollbackManager) WaitForReady(a provision.App, processName string, timeout time.Duration) error {
+	return m.waitErr
+}
+
+func TestApplyRollbackIgnoresWaitForReadyFailures(t *testing.T) {
+	manager := &fakeRollbackManager{waitErr: errors.New("not ready")}
+	args := &pipelineArgs{manager: manager}
+	plan := &deploymentPlan{
+		strategy: DeployStrategy{Kind: StrategyRollingUpdate},
+		image:    "old-image",
+		batches: []deploymentBatch{
+			{processName: "web", replicas: 3},
+			{processName: "web", replicas: 6},
+			{processName: "web", replicas: 9},
+		},
+	}
+	if err := applyRollback(args, plan); err != nil {
+		t.Fatalf("expected applyRollback to tolerate a WaitForReady failure, got %v", err)
+	}
+	if len(manager.deployed) != 3 {
+		t.Fatalf("expected all 3 batches to be deployed despite the WaitForReady failure, got %d", len(manager.deployed))
+	}
+}
+
+func TestRollingUpdateBatchesNoStrategy(t *testing.T) {
+	batches := rollingUpdateBatches("web", nil, 10, nil)
+	if len(batches) != 1 || batches[0].replicas != 10 {
+		t.Fatalf("expected a single batch with all replicas, got %+v", batches)
+	}
+}
+
+func TestRollingUpdateBatchesSurge(t *testing.T) {
+	batches := rollingUpdateBatches("web", nil, 10, &RollingUpdateStrategy{MaxSurge: 3})
+	var got []int
+	for _, b := range batches {
+		got = append(got, b.replicas)
+	}
+	want := []int{3, 6, 9, 10}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestCanaryBatchesRequiresWeight(t *testing.T) {
+	cases := []*CanaryStrategy{
+		nil,
+		{Weight: 0},
+		{Weight: 100},
+		{Weight: -1},
+	}
+	for _, strategy := range cases {
+		_, err := canaryBatches("web", nil, nil, 10, strategy)
+		if err == nil {
+			t.Fatalf("expected an error for strategy %+v", strategy)
+		}
+	}
+}
+
+func TestCanaryBatchesWeightRounding(t *testing.T) {
+	batches, err := canaryBatches("web", nil, nil, 10, &CanaryStrategy{Weight: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batches[0].replicas != 1 {
+		t.Errorf("expected a single canary replica, got %d", batches[0].replicas)
+	}
+	if batches[1].replicas != 10 {
+		t.Errorf("expected the promotion batch to hold all replicas, got %d", batches[1].replicas)
+	}
+	if batches[0].processName != "web-canary" {
+		t.Errorf("expected the canary batch to use the suffixed process name, got %q", batches[0].processName)
+	}
+}
+
+func TestRollbackStateReusesForwardDeployStrategy(t *testing.T) {
+	strategy := DeployStrategy{Kind: StrategyRollingUpdate, RollingUpdate: &RollingUpdateStrategy{MaxSurge: 2}}
+	args := &pipelineArgs{
+		currentImageSpec: ProcessSpec{"web": ProcessState{}},
+		newImageSpec:     ProcessSpec{"web": ProcessState{DeployStrategy: strategy}},
+	}
+	state, in := rollbackState(args, "web")
+	if !in {
+		t.Fatal("expected web to be found in currentImageSpec")
+	}
+	if state.DeployStrategy != strategy {
+		t.Errorf("expected the rollback state to carry the forward deploy's strategy, got %+v", state.DeployStrategy)
+	}
+}
+
+func TestRollbackStateMissingProcessIsNotFound(t *testing.T) {
+	args := &pipelineArgs{
+		currentImageSpec: ProcessSpec{},
+		newImageSpec:     ProcessSpec{"web": ProcessState{}},
+	}
+	if _, in := rollbackState(args, "web"); in {
+		t.Error("expected a process absent from currentImageSpec to report not found, so it's removed instead of rolled back")
+	}
+}
+
+func TestCanaryBatchesZeroReplicasStaysZero(t *testing.T) {
+	batches, err := canaryBatches("web", nil, nil, 0, &CanaryStrategy{Weight: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batches[0].replicas != 0 {
+		t.Errorf("expected a stopped process to keep a zero canary replica count, got %d", batches[0].replicas)
+	}
+}